@@ -0,0 +1,49 @@
+package anypg
+
+import (
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anyrl"
+	"github.com/unixpickle/lazyseq"
+)
+
+// FisherMode selects the algorithm NaturalPG uses to
+// compute a single Fisher-vector product.
+type FisherMode int
+
+const (
+	// FisherForward computes Fisher-vector products with
+	// forward-mode auto-diff (anyfwd): the policy is cloned,
+	// made dual via anyfwd.MakeFwd, and a single backward
+	// pass through KL(pi_old || pi_theta) yields F*direction
+	// directly as the Jacobian of the resulting gradient.
+	// This is what applyFisher implements, and is the
+	// default.
+	FisherForward FisherMode = iota
+
+	// FisherDoubleReverse computes Fisher-vector products
+	// via Pearlmutter's R-operator trick implemented with
+	// two reverse-mode passes instead of one forward and one
+	// reverse pass: first differentiate KL(pi_old || pi_theta)
+	// w.r.t. theta to get grad_theta KL symbolically, take
+	// its dot product with direction, then differentiate that
+	// scalar w.r.t. theta again to get F*direction. This
+	// would avoid the anyfwd.Creator and serializer.Copy that
+	// FisherForward pays on every Fisher-vector product, but
+	// requires anydiff to support differentiating through its
+	// own Propagate output, which it does not yet.
+	//
+	// Since that support doesn't exist, FisherDoubleReverse is
+	// not implemented: fisherVectorProduct rejects it with a
+	// panic (before spawning any shard goroutines) rather than
+	// silently running FisherForward in its place.
+	FisherDoubleReverse
+)
+
+// computeFisher computes F*direction with forward-mode
+// auto-diff. fisherVectorProduct only ever calls computeFisher
+// with n.FisherMode == FisherForward; it rejects
+// FisherDoubleReverse itself before any call reaches here.
+func (n *NaturalPG) computeFisher(r *anyrl.RolloutSet, direction anydiff.Grad,
+	oldOuts lazyseq.Rereader) anydiff.Grad {
+	return n.applyFisher(r, direction, oldOuts)
+}
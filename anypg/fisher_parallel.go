@@ -0,0 +1,164 @@
+package anypg
+
+import (
+	"sync"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anyrl"
+	"github.com/unixpickle/lazyseq"
+)
+
+// FisherWorker computes a partial Fisher-vector product
+// for one shard of a RolloutSet, e.g. on a remote machine
+// over gRPC. The worker is assumed to already have its own
+// copy of the policy and its current parameters.
+//
+// FisherShard returns the undamped product averaged over
+// the shard's timesteps, as applyFisher does for a whole
+// RolloutSet.
+type FisherWorker interface {
+	FisherShard(shard *anyrl.RolloutSet, direction anydiff.Grad) anydiff.Grad
+}
+
+// fisherVectorProduct computes F*direction, sharding the
+// work across n.Workers local goroutines and n.RemoteWorkers
+// remote workers (if either is configured) and reducing
+// the partial results with an elementwise sum, each one
+// weighted by its shard's share of the present timesteps
+// (since each partial is a mean over its own shard).
+//
+// If neither Workers nor RemoteWorkers is set, it falls
+// back to applyFisher on the whole rollout set.
+//
+// Each shard's Fisher-vector product is computed undamped;
+// n.Damping*direction is added exactly once here, to the
+// combined result, regardless of how many shards/workers
+// were involved, since applyFisher has no notion of
+// sharding and adding the damping term per shard would
+// scale it by the number of shards instead.
+func (n *NaturalPG) fisherVectorProduct(r *anyrl.RolloutSet, direction anydiff.Grad,
+	oldOuts lazyseq.Rereader) anydiff.Grad {
+	// Validated once up front, before any shard goroutines are
+	// spawned, so an unimplemented FisherMode fails loudly and
+	// immediately rather than being silently swallowed deep
+	// inside a per-shard call.
+	if n.FisherMode == FisherDoubleReverse {
+		panic("anypg: FisherMode is FisherDoubleReverse, which is not implemented; use FisherForward instead")
+	}
+
+	var result anydiff.Grad
+	if n.Workers <= 1 && len(n.RemoteWorkers) == 0 {
+		result = n.computeFisher(r, direction, oldOuts)
+	} else {
+		// shards[i] may be nil if r doesn't have enough rollouts
+		// to give every worker a non-empty share; shards keeps
+		// one slot per worker (rather than compacting them) so
+		// that shard index i still unambiguously means "local
+		// goroutine i" or "n.RemoteWorkers[i]" below.
+		shards := shardRolloutSet(r, n.Workers+len(n.RemoteWorkers))
+		partials := make([]anydiff.Grad, len(shards))
+		steps := make([]int, len(shards))
+
+		var wg sync.WaitGroup
+		for i, shard := range shards {
+			if shard == nil {
+				continue
+			}
+			i, shard := i, shard
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for batch := range shard.Inputs.ReadTape(0, -1) {
+					steps[i] += batch.NumPresent()
+				}
+				if i < len(n.RemoteWorkers) {
+					partials[i] = n.RemoteWorkers[i].FisherShard(shard, direction)
+					return
+				}
+				shardOuts := n.apply(lazyseq.TapeRereader(shard.Inputs), n.Policy)
+				partials[i] = n.computeFisher(shard, direction, shardOuts)
+			}()
+		}
+		wg.Wait()
+
+		totalSteps := 0
+		for _, s := range steps {
+			totalSteps += s
+		}
+		c := gradCreator(direction)
+		sum := zeroGrad(direction)
+		for i, partial := range partials {
+			if partial != nil {
+				partial.Scale(c.MakeNumeric(float64(steps[i]) / float64(totalSteps)))
+				addToGrad(sum, partial)
+			}
+		}
+		result = sum
+	}
+
+	n.addDamping(result, direction)
+	return result
+}
+
+// addDamping adds n.Damping*direction to result in place.
+// This is the single place damping is applied to a
+// Fisher-vector product, regardless of how many shards
+// direction's product was split across.
+func (n *NaturalPG) addDamping(result, direction anydiff.Grad) {
+	if n.Damping <= 0 {
+		return
+	}
+	c := gradCreator(direction)
+	scaledDirection := copyGrad(direction)
+	scaledDirection.Scale(c.MakeNumeric(n.Damping))
+	addToGrad(result, scaledDirection)
+}
+
+// shardRolloutSet splits r into numShards contiguous
+// shards of roughly equal size.
+//
+// The returned slice always has exactly numShards
+// elements: a position whose share of r.NumRollouts()
+// would be empty (e.g. because r has fewer rollouts than
+// numShards) holds nil rather than being dropped, so that
+// callers which assign meaning to a shard's position (e.g.
+// "shard i belongs to worker i") aren't desynced by a
+// shard disappearing from the middle of the slice.
+func shardRolloutSet(r *anyrl.RolloutSet, numShards int) []*anyrl.RolloutSet {
+	bounds := shardBounds(r.NumRollouts(), numShards)
+	shards := make([]*anyrl.RolloutSet, len(bounds))
+	for i, b := range bounds {
+		if b.end <= b.start {
+			continue
+		}
+		shards[i] = r.Slice(b.start, b.end)
+	}
+	return shards
+}
+
+// shardBound is a half-open [start, end) range of rollout
+// indices.
+type shardBound struct {
+	start, end int
+}
+
+// shardBounds computes the contiguous, roughly-equal index
+// ranges shardRolloutSet slices total rollouts into. It
+// always returns exactly numShards bounds (clamped to at
+// least 1): a bound with end <= start means that shard is
+// empty, which the caller must check for rather than
+// dropping, since dropping would shift every later shard
+// into the wrong position.
+func shardBounds(total, numShards int) []shardBound {
+	if numShards < 1 {
+		numShards = 1
+	}
+	bounds := make([]shardBound, numShards)
+	for i := range bounds {
+		bounds[i] = shardBound{
+			start: total * i / numShards,
+			end:   total * (i + 1) / numShards,
+		}
+	}
+	return bounds
+}
@@ -0,0 +1,50 @@
+package anypg
+
+import "testing"
+
+func TestShardBoundsPreservesPosition(t *testing.T) {
+	// Fewer rollouts than shards: some shards must come back
+	// empty rather than being dropped, since a dropped shard
+	// would shift every later shard's worker assignment.
+	bounds := shardBounds(2, 5)
+	if len(bounds) != 5 {
+		t.Fatalf("expected 5 bounds, got %d", len(bounds))
+	}
+
+	nonEmpty := 0
+	for _, b := range bounds {
+		if b.end > b.start {
+			nonEmpty++
+		}
+	}
+	if nonEmpty != 2 {
+		t.Errorf("expected 2 non-empty shards, got %d", nonEmpty)
+	}
+
+	// The bounds must be contiguous and cover [0, total).
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i].start != bounds[i-1].end {
+			t.Errorf("bounds[%d] does not start where bounds[%d] ended: %v vs %v",
+				i, i-1, bounds[i], bounds[i-1])
+		}
+	}
+	if bounds[0].start != 0 || bounds[len(bounds)-1].end != 2 {
+		t.Errorf("bounds don't cover [0, 2): %v", bounds)
+	}
+}
+
+func TestShardBoundsEvenSplit(t *testing.T) {
+	bounds := shardBounds(10, 5)
+	for _, b := range bounds {
+		if b.end-b.start != 2 {
+			t.Errorf("expected each of 5 shards of 10 to have size 2, got %v", b)
+		}
+	}
+}
+
+func TestShardBoundsClampsShardCount(t *testing.T) {
+	bounds := shardBounds(10, 0)
+	if len(bounds) != 1 {
+		t.Errorf("expected numShards<1 to be clamped to 1, got %d bounds", len(bounds))
+	}
+}
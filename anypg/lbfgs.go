@@ -0,0 +1,130 @@
+package anypg
+
+import (
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anyrl"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/lazyseq"
+)
+
+// Solver selects the algorithm NaturalPG uses to
+// approximately solve F*x = grad for the natural gradient
+// direction x.
+type Solver int
+
+const (
+	// SolverCG solves F*x = grad with Conjugate Gradients.
+	SolverCG Solver = iota
+
+	// SolverLBFGS solves F*x = grad with limited-memory
+	// BFGS (the Nocedal & Wright two-loop recursion),
+	// reusing curvature pairs gathered from Fisher-vector
+	// products computed on past calls to NaturalPG.Run
+	// rather than restarting from scratch every time.
+	SolverLBFGS
+)
+
+// DefaultLBFGSStore is the default number of (s, y)
+// curvature pairs SolverLBFGS keeps across calls to Run.
+const DefaultLBFGSStore = 10
+
+// lbfgsPair is one (s, y) curvature pair and its
+// precomputed rho = 1/(s . y), as used by the L-BFGS
+// two-loop recursion.
+type lbfgsPair struct {
+	s, y anydiff.Grad
+	rho  anyvec.Numeric
+}
+
+// lbfgsSolve approximates the solution to F*x = grad using
+// L-BFGS, updates n's curvature pairs with a fresh
+// Fisher-vector product, and stores the result back into
+// grad (as conjugateGradients does).
+func (n *NaturalPG) lbfgsSolve(r *anyrl.RolloutSet, policyOuts lazyseq.Reuser,
+	grad anydiff.Grad) {
+	direction := n.lbfgsDirection(grad)
+
+	policyOuts.Reuse()
+	fx := n.fisherVectorProduct(r, direction, policyOuts)
+
+	if n.lbfgsLastX != nil {
+		s := copyGrad(direction)
+		subFromGrad(s, n.lbfgsLastX)
+		y := copyGrad(fx)
+		subFromGrad(y, n.lbfgsLastFx)
+		n.pushLBFGSPair(s, y)
+	}
+	n.lbfgsLastX = copyGrad(direction)
+	n.lbfgsLastFx = copyGrad(fx)
+
+	setGrad(grad, direction)
+}
+
+// lbfgsDirection runs the L-BFGS two-loop recursion over
+// n's stored curvature pairs to approximate F^-1*grad.
+func (n *NaturalPG) lbfgsDirection(grad anydiff.Grad) anydiff.Grad {
+	c := gradCreator(grad)
+	ops := c.NumOps()
+	pairs := n.lbfgsPairs
+
+	q := copyGrad(grad)
+	alphas := make([]anyvec.Numeric, len(pairs))
+
+	for i := len(pairs) - 1; i >= 0; i-- {
+		p := pairs[i]
+		alphas[i] = ops.Mul(p.rho, dotGrad(p.s, q))
+		scaledY := copyGrad(p.y)
+		scaledY.Scale(alphas[i])
+		subFromGrad(q, scaledY)
+	}
+
+	result := q
+	if len(pairs) > 0 {
+		last := pairs[len(pairs)-1]
+		gamma := ops.Div(dotGrad(last.s, last.y), dotGrad(last.y, last.y))
+		result.Scale(gamma)
+	}
+
+	for i, p := range pairs {
+		beta := ops.Mul(p.rho, dotGrad(p.y, result))
+		scaledS := copyGrad(p.s)
+		scaledS.Scale(ops.Sub(alphas[i], beta))
+		addToGrad(result, scaledS)
+	}
+
+	return result
+}
+
+// pushLBFGSPair records a fresh (s, y) curvature pair,
+// evicting the oldest pair once n.store() is exceeded.
+// Pairs with non-positive curvature (s . y <= 0) are
+// dropped, since they would make the implicit Hessian
+// approximation indefinite.
+func (n *NaturalPG) pushLBFGSPair(s, y anydiff.Grad) {
+	sy := dotGrad(s, y)
+	if numToFloat64(sy) <= 0 {
+		return
+	}
+	c := gradCreator(s)
+	rho := c.NumOps().Div(c.MakeNumeric(1), sy)
+	n.lbfgsPairs = append(n.lbfgsPairs, lbfgsPair{s: s, y: y, rho: rho})
+	if len(n.lbfgsPairs) > n.store() {
+		n.lbfgsPairs = n.lbfgsPairs[1:]
+	}
+}
+
+func (n *NaturalPG) store() int {
+	if n.Store != 0 {
+		return n.Store
+	}
+	return DefaultLBFGSStore
+}
+
+// gradCreator extracts the anyvec.Creator shared by every
+// vector in g.
+func gradCreator(g anydiff.Grad) anyvec.Creator {
+	for _, v := range g {
+		return v.Creator()
+	}
+	panic("cannot get creator of empty gradient")
+}
@@ -0,0 +1,108 @@
+package anypg
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+)
+
+func TestLBFGSStore(t *testing.T) {
+	if (&NaturalPG{}).store() != DefaultLBFGSStore {
+		t.Errorf("expected default of %d pairs", DefaultLBFGSStore)
+	}
+	if (&NaturalPG{Store: 3}).store() != 3 {
+		t.Error("explicit Store was not honored")
+	}
+}
+
+// TestLBFGSDirectionNoPairs checks that, with no curvature
+// pairs gathered yet, the two-loop recursion degenerates to
+// the identity (direction == grad), since both loops and the
+// gamma-scaling step are all no-ops over an empty pairs list.
+func TestLBFGSDirectionNoPairs(t *testing.T) {
+	c := testCreator()
+	v1, v2 := scalarVar(c), scalarVar(c)
+	grad := dimGrad(c, []*anydiff.Var{v1, v2}, []float64{3, 4})
+
+	n := &NaturalPG{}
+	dir := n.lbfgsDirection(grad)
+
+	x1, x2 := gradValue(c, dir, v1), gradValue(c, dir, v2)
+	if !approxEqual(x1, 3, 1e-4) || !approxEqual(x2, 4, 1e-4) {
+		t.Errorf("expected direction (3, 4), got (%v, %v)", x1, x2)
+	}
+}
+
+// TestLBFGSDirectionOnePair hand-derives the two-loop
+// recursion's result for a single curvature pair s = (1, 0),
+// y = (2, 0) (so rho = 1/(s.y) = 0.5) applied to
+// grad = (3, 4):
+//
+//	alpha = rho*(s.grad)        = 0.5*3        = 1.5
+//	q      = grad - alpha*y     = (3,4)-1.5*(2,0) = (0, 4)
+//	gamma  = (s.y)/(y.y)        = 2/4          = 0.5
+//	q     *= gamma              = (0, 2)
+//	beta   = rho*(y.q)          = 0.5*0        = 0
+//	result = q + (alpha-beta)*s = (0,2)+1.5*(1,0) = (1.5, 2)
+func TestLBFGSDirectionOnePair(t *testing.T) {
+	c := testCreator()
+	v1, v2 := scalarVar(c), scalarVar(c)
+	grad := dimGrad(c, []*anydiff.Var{v1, v2}, []float64{3, 4})
+
+	n := &NaturalPG{}
+	s := dimGrad(c, []*anydiff.Var{v1, v2}, []float64{1, 0})
+	y := dimGrad(c, []*anydiff.Var{v1, v2}, []float64{2, 0})
+	n.pushLBFGSPair(s, y)
+
+	dir := n.lbfgsDirection(grad)
+
+	x1, x2 := gradValue(c, dir, v1), gradValue(c, dir, v2)
+	if !approxEqual(x1, 1.5, 1e-3) || !approxEqual(x2, 2, 1e-3) {
+		t.Errorf("expected direction (1.5, 2), got (%v, %v)", x1, x2)
+	}
+}
+
+// TestPushLBFGSPairRejectsNonPositiveCurvature checks that a
+// pair with s.y <= 0 is dropped rather than stored, since it
+// would make the implicit Hessian approximation indefinite.
+func TestPushLBFGSPairRejectsNonPositiveCurvature(t *testing.T) {
+	c := testCreator()
+	v := scalarVar(c)
+
+	n := &NaturalPG{}
+	s := dimGrad(c, []*anydiff.Var{v}, []float64{1})
+	y := dimGrad(c, []*anydiff.Var{v}, []float64{-1})
+	n.pushLBFGSPair(s, y)
+
+	if len(n.lbfgsPairs) != 0 {
+		t.Errorf("expected a non-positive-curvature pair to be dropped, got %d pairs",
+			len(n.lbfgsPairs))
+	}
+}
+
+// TestPushLBFGSPairEvictsOldest checks that once more than
+// n.store() pairs have been pushed, the oldest is evicted
+// rather than the newest.
+func TestPushLBFGSPairEvictsOldest(t *testing.T) {
+	c := testCreator()
+	v := scalarVar(c)
+
+	n := &NaturalPG{Store: 2}
+	for _, sy := range [][2]float64{{1, 1}, {2, 1}, {3, 1}} {
+		s := dimGrad(c, []*anydiff.Var{v}, []float64{sy[0]})
+		y := dimGrad(c, []*anydiff.Var{v}, []float64{sy[1]})
+		n.pushLBFGSPair(s, y)
+	}
+
+	if len(n.lbfgsPairs) != 2 {
+		t.Fatalf("expected eviction to cap stored pairs at 2, got %d", len(n.lbfgsPairs))
+	}
+	// rho = 1/(s.y): the surviving pairs should be the second
+	// (s=2,y=1 -> rho=0.5) and third (s=3,y=1 -> rho=1/3), in
+	// that order, with the first (s=1,y=1 -> rho=1) evicted.
+	gotRho0 := numToFloat64(n.lbfgsPairs[0].rho)
+	gotRho1 := numToFloat64(n.lbfgsPairs[1].rho)
+	if !approxEqual(gotRho0, 0.5, 1e-3) || !approxEqual(gotRho1, 1.0/3.0, 1e-3) {
+		t.Errorf("expected surviving rhos (0.5, 0.3333), got (%v, %v)", gotRho0, gotRho1)
+	}
+}
@@ -1,6 +1,8 @@
 package anypg
 
 import (
+	"math"
+
 	"github.com/unixpickle/anydiff"
 	"github.com/unixpickle/anydiff/anyfwd"
 	"github.com/unixpickle/anydiff/anyseq"
@@ -40,7 +42,9 @@ type NaturalPG struct {
 	// Damping specifies the damping coefficient for the
 	// Conjugate Gradients algorithm.
 	// It is the multiple of the identity matrix to add
-	// to the Fisher information matrix.
+	// to the Fisher information matrix. It is added once per
+	// Fisher-vector product by fisherVectorProduct, regardless
+	// of how many shards/workers that product is split across.
 	Damping float64
 
 	// ApplyPolicy applies a policy to an input sequence.
@@ -64,6 +68,66 @@ type NaturalPG struct {
 	//
 	// If nil, no regularization is used.
 	Regularizer Regularizer
+
+	// Tolerance is the relative residual at which Conjugate
+	// Gradients stops early, i.e. it stops once
+	// sqrt(residualMag) < Tolerance*sqrt(initialResidualMag).
+	//
+	// If 0, no early stopping based on tolerance occurs.
+	Tolerance float64
+
+	// MaxKLQuadratic caps the quadratic model of the KL
+	// divergence, 0.5*x^T*F*x, that Conjugate Gradients is
+	// allowed to explore. This is the CG-Steihaug style
+	// trust-region stopping rule: once the current iterate
+	// would exceed the budget, the previous iterate is kept
+	// and CG stops.
+	//
+	// If 0, no such cap is enforced.
+	MaxKLQuadratic float64
+
+	// Preconditioner, if non-nil, is applied to the residual
+	// at the start of each Conjugate Gradients iteration,
+	// e.g. to implement a diagonal Fisher approximation.
+	//
+	// If nil, no preconditioning is performed.
+	Preconditioner func(anydiff.Grad) anydiff.Grad
+
+	// Solver selects the algorithm used to approximately
+	// solve F*x = grad for the natural gradient direction.
+	//
+	// If 0 (SolverCG), Conjugate Gradients is used.
+	Solver Solver
+
+	// Store is the number of (s, y) curvature pairs that
+	// SolverLBFGS keeps across calls to Run.
+	//
+	// If 0, DefaultLBFGSStore is used.
+	Store int
+
+	// Workers specifies the number of goroutines across
+	// which to shard each Fisher-vector product.
+	//
+	// If 0 or 1, Fisher-vector products are computed on a
+	// single goroutine.
+	Workers int
+
+	// RemoteWorkers, if non-empty, are given their own
+	// rollout shards in addition to (or instead of, if
+	// Workers is 0) the local goroutines spawned for
+	// Workers, e.g. to distribute Fisher-vector products
+	// across machines.
+	RemoteWorkers []FisherWorker
+
+	// FisherMode selects the algorithm used to compute each
+	// Fisher-vector product.
+	//
+	// If 0 (FisherForward), forward-mode auto-diff is used.
+	FisherMode FisherMode
+
+	lbfgsPairs  []lbfgsPair
+	lbfgsLastX  anydiff.Grad
+	lbfgsLastFx anydiff.Grad
 }
 
 // Run computes the natural gradient for the rollouts.
@@ -100,39 +164,84 @@ func (n *NaturalPG) run(r *anyrl.RolloutSet) *naturalPGRes {
 		res.ReducedOut = lazyseq.MakeReuser(n.apply(in, n.Policy))
 	}
 
-	n.conjugateGradients(res.ReducedRollouts, res.ReducedOut, res.Grad)
+	res.VanillaGrad = copyGrad(res.Grad)
+	if n.Solver == SolverLBFGS {
+		n.lbfgsSolve(res.ReducedRollouts, res.ReducedOut, res.Grad)
+	} else {
+		n.conjugateGradients(res.ReducedRollouts, res.ReducedOut, res.Grad)
+	}
 
 	return res
 }
 
 func (n *NaturalPG) conjugateGradients(r *anyrl.RolloutSet, policyOuts lazyseq.Reuser,
 	grad anydiff.Grad) {
-	c := r.Creator()
-	ops := c.NumOps()
+	n.solveCG(func(proj anydiff.Grad) anydiff.Grad {
+		policyOuts.Reuse()
+		return n.fisherVectorProduct(r, proj, policyOuts)
+	}, grad)
+}
 
-	// Solving "Fx = grad" for x, where F is the
-	// Fisher matrix.
-	// Algorithm taken from
-	// https://en.wikipedia.org/wiki/Conjugate_gradient_method#The_resulting_algorithm.
+// solveCG solves "Fx = grad" for x in place (overwriting
+// grad with x), where apply computes F*p for a direction p.
+// It is the numeric core of conjugateGradients, pulled out
+// so it can be driven by a hand-constructed linear operator
+// in tests instead of a real Fisher-vector product.
+//
+// It uses preconditioned Conjugate Gradients with a
+// Polak-Ribiere beta (restarting to steepest descent
+// whenever it would go negative), an early-stopping
+// tolerance on the relative residual norm, a
+// CG-Steihaug-style cap on the quadratic model of the
+// KL, and negative-curvature detection.
+// Algorithm adapted from
+// https://en.wikipedia.org/wiki/Conjugate_gradient_method#The_resulting_algorithm
+// and https://en.wikipedia.org/wiki/Conjugate_gradient_method#Preconditioning.
+func (n *NaturalPG) solveCG(apply func(anydiff.Grad) anydiff.Grad, grad anydiff.Grad) {
+	c := gradCreator(grad)
+	ops := c.NumOps()
 
 	// x = 0
 	x := zeroGrad(grad)
 
 	// r = b - Ax = b
 	residual := copyGrad(grad)
+	z := n.precondition(residual)
 
-	// p = r
-	proj := copyGrad(grad)
+	// p = z
+	proj := copyGrad(z)
 
-	residualMag := dotGrad(residual, residual)
+	initialResidualMag := dotGrad(residual, residual)
+	rzOld := dotGrad(residual, z)
+	quadModel := 0.0
 
 	for i := 0; i < n.iters(); i++ {
+		if n.belowTolerance(dotGrad(residual, residual), initialResidualMag) {
+			break
+		}
+
 		// A*p
-		policyOuts.Reuse()
-		appliedProj := n.applyFisher(r, proj, policyOuts)
+		appliedProj := apply(proj)
+
+		pAp := dotGrad(proj, appliedProj)
+		if numToFloat64(pAp) <= 0 {
+			// Negative (or zero) curvature: the quadratic
+			// model is unbounded below along this direction,
+			// so stop and keep the current iterate.
+			break
+		}
+
+		alpha := ops.Div(rzOld, pAp)
+		alphaF := numToFloat64(alpha)
 
-		// (r dot r) / (p dot A*p)
-		alpha := ops.Div(residualMag, dotGrad(proj, appliedProj))
+		// Incremental reduction in the quadratic model
+		// 0.5*x^T*F*x - x^T*grad from taking this step.
+		deltaModel := alphaF*numToFloat64(dotGrad(proj, residual)) -
+			0.5*alphaF*alphaF*numToFloat64(pAp)
+		if n.MaxKLQuadratic > 0 && quadModel+deltaModel > n.MaxKLQuadratic {
+			break
+		}
+		quadModel += deltaModel
 
 		// x = x + alpha*p
 		alphaProj := copyGrad(proj)
@@ -140,17 +249,27 @@ func (n *NaturalPG) conjugateGradients(r *anyrl.RolloutSet, policyOuts lazyseq.R
 		addToGrad(x, alphaProj)
 
 		// r = r - alpha*A*p
+		oldResidual := residual
+		residual = copyGrad(residual)
 		appliedProj.Scale(alpha)
 		subFromGrad(residual, appliedProj)
 
-		// (newR dot newR) / (r dot r)
-		newResidualMag := dotGrad(residual, residual)
-		beta := ops.Div(newResidualMag, residualMag)
-		residualMag = newResidualMag
+		z = n.precondition(residual)
+		rzNew := dotGrad(residual, z)
+
+		// Polak-Ribiere beta: (z_new . (r_new - r_old)) / (z_old . r_old),
+		// restarted to steepest descent (beta=0) if negative.
+		residualDiff := copyGrad(residual)
+		subFromGrad(residualDiff, oldResidual)
+		beta := ops.Div(dotGrad(z, residualDiff), rzOld)
+		if numToFloat64(beta) < 0 {
+			beta = c.MakeNumeric(0)
+		}
+		rzOld = rzNew
 
-		// p = beta*p + r
+		// p = beta*p + z
 		oldProj := proj
-		proj = copyGrad(residual)
+		proj = copyGrad(z)
 		oldProj.Scale(beta)
 		addToGrad(proj, oldProj)
 	}
@@ -158,6 +277,32 @@ func (n *NaturalPG) conjugateGradients(r *anyrl.RolloutSet, policyOuts lazyseq.R
 	setGrad(grad, x)
 }
 
+// precondition applies n.Preconditioner to the residual,
+// or returns a copy of it unchanged if no preconditioner
+// is configured.
+func (n *NaturalPG) precondition(residual anydiff.Grad) anydiff.Grad {
+	if n.Preconditioner == nil {
+		return copyGrad(residual)
+	}
+	return n.Preconditioner(residual)
+}
+
+// belowTolerance reports whether Conjugate Gradients
+// should stop early because the residual has shrunk
+// enough relative to its initial magnitude.
+func (n *NaturalPG) belowTolerance(residualMag, initialResidualMag anyvec.Numeric) bool {
+	if n.Tolerance <= 0 {
+		return false
+	}
+	ratio := math.Sqrt(numToFloat64(residualMag) / numToFloat64(initialResidualMag))
+	return ratio < n.Tolerance
+}
+
+// applyFisher computes F*grad via a single forward-mode
+// pass through KL(pi_old || pi_theta), undamped. Damping is
+// applied once by the caller (fisherVectorProduct), not
+// here, so that it isn't double-counted when a Fisher-vector
+// product is split across shards.
 func (n *NaturalPG) applyFisher(r *anyrl.RolloutSet, grad anydiff.Grad,
 	oldOuts lazyseq.Rereader) anydiff.Grad {
 	c := &anyfwd.Creator{
@@ -195,11 +340,6 @@ func (n *NaturalPG) applyFisher(r *anyrl.RolloutSet, grad anydiff.Grad,
 	for newParam, paramGrad := range newGrad {
 		oldParam := paramMap[newParam]
 		out[oldParam] = paramGrad.(*anyfwd.Vector).Jacobian[0]
-		if n.Damping > 0 {
-			scaledOld := grad[oldParam].Copy()
-			scaledOld.Scale(c.ValueCreator.MakeNumeric(n.Damping))
-			out[oldParam].Add(scaledOld)
-		}
 	}
 
 	return out
@@ -248,6 +388,11 @@ type naturalPGRes struct {
 	PolicyOut lazyseq.Reuser
 	ZeroGrad  bool
 
+	// VanillaGrad is a copy of Grad as it was before
+	// conjugateGradients or lbfgsSolve overwrote it with the natural
+	// gradient direction. It is nil if ZeroGrad is true.
+	VanillaGrad anydiff.Grad
+
 	// Always non-nil, but may equal the unreduced version.
 	ReducedOut      lazyseq.Reuser
 	ReducedRollouts *anyrl.RolloutSet
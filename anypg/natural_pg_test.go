@@ -0,0 +1,124 @@
+package anypg
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anyvec"
+)
+
+func TestBelowTolerance(t *testing.T) {
+	n := &NaturalPG{Tolerance: 0.1}
+
+	// residual shrunk to 1% of its initial magnitude: well
+	// under the 10% tolerance.
+	if !n.belowTolerance(0.0001, 1.0) {
+		t.Error("expected a residual at 1% of its initial magnitude to be below tolerance")
+	}
+
+	// residual still at its initial magnitude: not below
+	// tolerance.
+	if n.belowTolerance(1.0, 1.0) {
+		t.Error("expected a residual at 100% of its initial magnitude to not be below tolerance")
+	}
+
+	// Tolerance unset: never stop early, regardless of how
+	// small the residual is.
+	unset := &NaturalPG{}
+	if unset.belowTolerance(0.0, 1.0) {
+		t.Error("expected belowTolerance to always be false when Tolerance is unset")
+	}
+}
+
+func TestNaturalPGIters(t *testing.T) {
+	if (&NaturalPG{}).iters() != DefaultConjGradIters {
+		t.Errorf("expected default of %d iterations", DefaultConjGradIters)
+	}
+	if (&NaturalPG{Iters: 7}).iters() != 7 {
+		t.Error("explicit Iters was not honored")
+	}
+}
+
+// diagApply builds a hand-constructed "Fisher matrix":
+// F*p = diag(d1, d2)*p for a 2-dimensional p represented by
+// (v1, v2), letting solveCG be exercised against a known
+// linear system without any of the RolloutSet/policy
+// machinery real Fisher-vector products need.
+func diagApply(c anyvec.Creator, v1, v2 *anydiff.Var, d1, d2 float64) func(anydiff.Grad) anydiff.Grad {
+	return func(p anydiff.Grad) anydiff.Grad {
+		return dimGrad(c, []*anydiff.Var{v1, v2}, []float64{
+			gradValue(c, p, v1) * d1,
+			gradValue(c, p, v2) * d2,
+		})
+	}
+}
+
+// TestSolveCGDiagonalConvergesExactly checks solveCG against
+// F*x = b for F = diag(2, 3), b = (4, 9), which Conjugate
+// Gradients (even unpreconditioned) always solves exactly
+// within N=2 iterations for a 2-dimensional diagonal system.
+// The exact solution is x = (2, 3).
+func TestSolveCGDiagonalConvergesExactly(t *testing.T) {
+	c := testCreator()
+	v1, v2 := scalarVar(c), scalarVar(c)
+	grad := dimGrad(c, []*anydiff.Var{v1, v2}, []float64{4, 9})
+
+	n := &NaturalPG{Iters: 2}
+	n.solveCG(diagApply(c, v1, v2, 2, 3), grad)
+
+	x1, x2 := gradValue(c, grad, v1), gradValue(c, grad, v2)
+	if !approxEqual(x1, 2, 0.02) || !approxEqual(x2, 3, 0.02) {
+		t.Errorf("expected solution (2, 3), got (%v, %v)", x1, x2)
+	}
+}
+
+// TestSolveCGNegativeCurvatureStopsImmediately checks that
+// solveCG detects a non-positive-definite operator (F = -I)
+// on the very first iteration and leaves x at its initial
+// value of 0, rather than taking a step that would increase
+// (rather than decrease) the quadratic model.
+func TestSolveCGNegativeCurvatureStopsImmediately(t *testing.T) {
+	c := testCreator()
+	v1, v2 := scalarVar(c), scalarVar(c)
+	grad := dimGrad(c, []*anydiff.Var{v1, v2}, []float64{1, 1})
+
+	n := &NaturalPG{Iters: 5}
+	n.solveCG(func(p anydiff.Grad) anydiff.Grad {
+		return dimGrad(c, []*anydiff.Var{v1, v2}, []float64{
+			-gradValue(c, p, v1),
+			-gradValue(c, p, v2),
+		})
+	}, grad)
+
+	x1, x2 := gradValue(c, grad, v1), gradValue(c, grad, v2)
+	if !approxEqual(x1, 0, 1e-6) || !approxEqual(x2, 0, 1e-6) {
+		t.Errorf("expected negative curvature to leave x at 0, got (%v, %v)", x1, x2)
+	}
+}
+
+// TestSolveCGMaxKLQuadraticStopsEarly checks that
+// MaxKLQuadratic caps progress before Conjugate Gradients
+// reaches the exact solution: with F = diag(2, 3), b = (4, 9)
+// as in TestSolveCGDiagonalConvergesExactly, the quadratic
+// model's increment after the first iteration is about
+// 17.1, and after the second iteration about 17.5 total; a
+// cap of 17.3 should therefore keep only the first
+// iteration's step, x1 = (4, 9)*(97/275) =
+// (1.4109, 3.1745), rather than the fully-converged (2, 3).
+func TestSolveCGMaxKLQuadraticStopsEarly(t *testing.T) {
+	c := testCreator()
+	v1, v2 := scalarVar(c), scalarVar(c)
+	grad := dimGrad(c, []*anydiff.Var{v1, v2}, []float64{4, 9})
+
+	n := &NaturalPG{Iters: 5, MaxKLQuadratic: 17.3}
+	n.solveCG(diagApply(c, v1, v2, 2, 3), grad)
+
+	x1, x2 := gradValue(c, grad, v1), gradValue(c, grad, v2)
+	if !approxEqual(x1, 1.4109, 0.02) || !approxEqual(x2, 3.1745, 0.02) {
+		t.Errorf("expected the capped first-iteration solution (1.4109, 3.1745), got (%v, %v)",
+			x1, x2)
+	}
+	if approxEqual(x1, 2, 0.1) && approxEqual(x2, 3, 0.1) {
+		t.Error("MaxKLQuadratic did not stop CG before it reached the uncapped solution")
+	}
+}
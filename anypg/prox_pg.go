@@ -0,0 +1,289 @@
+package anypg
+
+import (
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyrl"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/lazyseq"
+	"github.com/unixpickle/lazyseq/lazyrnn"
+	"github.com/unixpickle/serializer"
+)
+
+// Default settings for ProxPG.
+const (
+	DefaultProxPGEpochs = 10
+	DefaultKLTarget     = 0.01
+	DefaultInitialBeta  = 1.0
+	DefaultProxPGStep   = 1e-3
+)
+
+// ProxPG implements the adaptive KL-penalty variant of
+// Proximal Policy Optimization (PPO).
+//
+// Rather than solving F^-1*grad as NaturalPG does, ProxPG
+// runs several epochs of minibatch gradient ascent on the
+// KL-penalized surrogate objective
+//
+//     E[ratio(theta)*reward] - Beta*KL(pi_old || pi_theta)
+//
+// where reward is the raw per-timestep reward from the
+// RolloutSet's Rewards; ActionJudger is not applied to this
+// objective. It adapts Beta after every call to Run based on how far
+// the realized KL strayed from KLTarget: it is doubled if
+// the mean KL exceeded 1.5*KLTarget and halved if it fell
+// below KLTarget/1.5. This gives users a cheaper
+// alternative to the Fisher/CG machinery in NaturalPG,
+// while keeping the same trust-region philosophy.
+type ProxPG struct {
+	Policy      anyrnn.Block
+	Params      []*anydiff.Var
+	ActionSpace NaturalActionSpace
+
+	// ActionJudger is used to judge actions for the vanilla
+	// policy gradient that Run returns. It is not used by
+	// the surrogate objective that the updates ascend.
+	//
+	// If nil, TotalJudger is used.
+	ActionJudger ActionJudger
+
+	// Regularizer is used to regularize the action space.
+	//
+	// If nil, no regularization is used.
+	Regularizer Regularizer
+
+	// ApplyPolicy applies a policy to an input sequence.
+	// If nil, back-propagation through time is used.
+	ApplyPolicy func(s lazyseq.Rereader, b anyrnn.Block) lazyseq.Rereader
+
+	// Epochs is the number of minibatch gradient ascent
+	// passes to run over the rollouts on each call to Run.
+	//
+	// If 0, DefaultProxPGEpochs is used.
+	Epochs int
+
+	// BatchSize is the minibatch size used within each
+	// epoch.
+	//
+	// If 0, the whole rollout set is used as a single batch.
+	BatchSize int
+
+	// StepSize scales each minibatch gradient step.
+	//
+	// If 0, DefaultProxPGStep is used.
+	StepSize float64
+
+	// KLTarget is the desired mean KL divergence between the
+	// old and new policy.
+	//
+	// If 0, DefaultKLTarget is used.
+	KLTarget float64
+
+	// Beta is the current KL penalty coefficient.
+	//
+	// If 0 the first time Run is called, DefaultInitialBeta
+	// is used.
+	Beta float64
+}
+
+// Run executes p.epochs() passes of minibatch gradient
+// ascent on the KL-penalized surrogate objective, updating
+// p.Params in place, then adapts p.Beta based on the
+// realized KL divergence between the pre- and post-update
+// policy.
+//
+// It returns the vanilla policy gradient computed before
+// any updates were applied, analogous to NaturalPG.Run.
+func (p *ProxPG) Run(r *anyrl.RolloutSet) anydiff.Grad {
+	copied, err := serializer.Copy(p.Policy)
+	if err != nil {
+		panic(err)
+	}
+	oldPolicy := copied.(anyrnn.Block)
+
+	vanillaGrad := p.policyGrad(r)
+
+	if p.Beta == 0 {
+		p.Beta = DefaultInitialBeta
+	}
+
+	for epoch := 0; epoch < p.epochs(); epoch++ {
+		for _, batch := range p.batches(r) {
+			p.sgdStep(batch, oldPolicy)
+		}
+	}
+
+	p.adaptBeta(numToFloat64(meanKL(p.ActionSpace, p.apply(lazyseq.TapeRereader(r.Inputs), oldPolicy),
+		p.apply(lazyseq.TapeRereader(r.Inputs), p.Policy))))
+
+	return vanillaGrad
+}
+
+// sgdStep takes one gradient ascent step on r, using
+// oldPolicy as the fixed reference distribution for both
+// the importance ratio and the KL penalty.
+func (p *ProxPG) sgdStep(r *anyrl.RolloutSet, oldPolicy anyrnn.Block) {
+	grad := p.surrogateGrad(r, oldPolicy)
+	klG := p.klGrad(r, oldPolicy)
+
+	c := p.Params[0].Vector.Creator()
+	step := copyGrad(grad)
+	scaledKL := copyGrad(klG)
+	scaledKL.Scale(c.MakeNumeric(p.Beta))
+	subFromGrad(step, scaledKL)
+	step.Scale(c.MakeNumeric(p.stepSize()))
+	applyStep(p.Params, step)
+}
+
+// policyGrad computes the vanilla policy gradient of r at
+// the current p.Params. It is only used for Run's return
+// value (to mirror NaturalPG.Run); sgdStep uses
+// surrogateGrad instead, since after the first step
+// p.Params has drifted from oldPolicy and the importance
+// ratio can no longer be assumed to be 1.
+func (p *ProxPG) policyGrad(r *anyrl.RolloutSet) anydiff.Grad {
+	curOuts := lazyseq.MakeReuser(p.apply(lazyseq.TapeRereader(r.Inputs), p.Policy))
+	pg := &PG{
+		Policy: func(in lazyseq.Rereader) lazyseq.Rereader {
+			return curOuts
+		},
+		Params:       p.Params,
+		ActionSpace:  p.ActionSpace,
+		ActionJudger: p.ActionJudger,
+		Regularizer:  p.Regularizer,
+	}
+	return pg.Run(r)
+}
+
+// surrogateGrad computes the gradient, with respect to
+// p.Params, of the mean ratio-weighted surrogate objective
+// E[ratio(theta)*reward], where
+// ratio(theta) = exp(logp_theta(a) - logp_old(a)).
+//
+// Unlike policyGrad, this accounts for theta having
+// drifted away from oldPolicy across earlier epochs or
+// minibatches within the same Run call.
+func (p *ProxPG) surrogateGrad(r *anyrl.RolloutSet, oldPolicy anyrnn.Block) anydiff.Grad {
+	oldOuts := collectVectors(p.apply(lazyseq.TapeRereader(r.Inputs), oldPolicy))
+	sampledOuts := collectVectors(lazyseq.TapeRereader(r.SampledOuts))
+	rewards := collectVectors(lazyseq.TapeRereader(r.Rewards))
+
+	newOuts := p.apply(lazyseq.TapeRereader(r.Inputs), p.Policy)
+	idx := 0
+	surrSeq := lazyseq.Map(newOuts, func(v anydiff.Res, num int) anydiff.Res {
+		i := idx % len(oldOuts)
+		idx++
+
+		oldLogProb := p.ActionSpace.LogProb(anydiff.NewConst(oldOuts[i]), sampledOuts[i], num)
+		newLogProb := p.ActionSpace.LogProb(v, sampledOuts[i], num)
+		ratio := anydiff.Exp(anydiff.Sub(newLogProb, oldLogProb))
+		return anydiff.Mul(ratio, anydiff.NewConst(rewards[i]))
+	})
+	mean := lazyseq.Mean(surrSeq)
+
+	return p.propagateToParams(mean)
+}
+
+// klGrad computes the gradient, with respect to p.Params,
+// of the mean KL divergence between oldPolicy's outputs and
+// the current policy's outputs.
+func (p *ProxPG) klGrad(r *anyrl.RolloutSet, oldPolicy anyrnn.Block) anydiff.Grad {
+	oldOuts := collectVectors(p.apply(lazyseq.TapeRereader(r.Inputs), oldPolicy))
+
+	newOuts := p.apply(lazyseq.TapeRereader(r.Inputs), p.Policy)
+	idx := 0
+	klSeq := lazyseq.Map(newOuts, func(v anydiff.Res, num int) anydiff.Res {
+		old := oldOuts[idx%len(oldOuts)]
+		idx++
+		return p.ActionSpace.KL(anydiff.NewConst(old), v, num)
+	})
+	mean := lazyseq.Mean(klSeq)
+
+	return p.propagateToParams(mean)
+}
+
+// propagateToParams back-propagates a scalar anydiff.Res
+// (e.g. the output of lazyseq.Mean) to p.Params.
+func (p *ProxPG) propagateToParams(mean anydiff.Res) anydiff.Grad {
+	grad := anydiff.Grad{}
+	for _, v := range p.Params {
+		grad[v] = v.Vector.Creator().MakeVector(v.Vector.Len())
+	}
+
+	c := p.Params[0].Vector.Creator()
+	one := c.MakeVector(1)
+	one.AddScalar(c.MakeNumeric(1))
+	mean.Propagate(one, grad)
+
+	return grad
+}
+
+// collectVectors reads every batch out of seq and returns
+// their packed vectors in order.
+func collectVectors(seq lazyseq.Rereader) []anyvec.Vector {
+	var res []anyvec.Vector
+	for batch := range seq.Forward() {
+		res = append(res, batch.Packed)
+	}
+	return res
+}
+
+// adaptBeta doubles or halves p.Beta based on how far
+// meanKL strayed from p.klTarget().
+func (p *ProxPG) adaptBeta(meanKL float64) {
+	target := p.klTarget()
+	switch {
+	case meanKL > 1.5*target:
+		p.Beta *= 2
+	case meanKL < target/1.5:
+		p.Beta /= 2
+	}
+}
+
+// batches splits r into minibatches of roughly p.BatchSize
+// rollouts each, or returns r itself as a single batch if
+// BatchSize is unset.
+func (p *ProxPG) batches(r *anyrl.RolloutSet) []*anyrl.RolloutSet {
+	if p.BatchSize <= 0 {
+		return []*anyrl.RolloutSet{r}
+	}
+	total := r.NumRollouts()
+	numBatches := (total + p.BatchSize - 1) / p.BatchSize
+
+	var batches []*anyrl.RolloutSet
+	for _, shard := range shardRolloutSet(r, numBatches) {
+		if shard != nil {
+			batches = append(batches, shard)
+		}
+	}
+	return batches
+}
+
+func (p *ProxPG) apply(in lazyseq.Rereader, b anyrnn.Block) lazyseq.Rereader {
+	if p.ApplyPolicy == nil {
+		tape, writer := lazyseq.ReferenceTape(in.Creator())
+		return lazyseq.SeqRereader(lazyrnn.BPTT(in, b), tape, writer)
+	}
+	return p.ApplyPolicy(in, b)
+}
+
+func (p *ProxPG) epochs() int {
+	if p.Epochs != 0 {
+		return p.Epochs
+	}
+	return DefaultProxPGEpochs
+}
+
+func (p *ProxPG) stepSize() float64 {
+	if p.StepSize != 0 {
+		return p.StepSize
+	}
+	return DefaultProxPGStep
+}
+
+func (p *ProxPG) klTarget() float64 {
+	if p.KLTarget != 0 {
+		return p.KLTarget
+	}
+	return DefaultKLTarget
+}
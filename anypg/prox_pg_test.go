@@ -0,0 +1,25 @@
+package anypg
+
+import "testing"
+
+func TestProxPGAdaptBeta(t *testing.T) {
+	tests := []struct {
+		meanKL   float64
+		klTarget float64
+		beta     float64
+		want     float64
+	}{
+		{meanKL: 0.02, klTarget: 0.01, beta: 1, want: 2},    // KL way above target: double.
+		{meanKL: 0.001, klTarget: 0.01, beta: 1, want: 0.5}, // KL way below target: halve.
+		{meanKL: 0.01, klTarget: 0.01, beta: 1, want: 1},    // KL at target: leave alone.
+		{meanKL: 0.012, klTarget: 0.01, beta: 1, want: 1},   // Within the 1.5x dead zone.
+	}
+	for _, test := range tests {
+		p := &ProxPG{KLTarget: test.klTarget, Beta: test.beta}
+		p.adaptBeta(test.meanKL)
+		if p.Beta != test.want {
+			t.Errorf("meanKL=%v klTarget=%v: beta=%v want=%v", test.meanKL, test.klTarget,
+				p.Beta, test.want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package anypg
+
+import (
+	"math"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anyrl"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/lazyseq"
+)
+
+// DefaultLineSearchIters is the default number of
+// backtracking steps TRPO will attempt before giving up
+// on a natural gradient step.
+const DefaultLineSearchIters = 10
+
+// DefaultLineSearchShrink is the default factor by which
+// the step size is shrunk after each failed backtracking
+// attempt.
+const DefaultLineSearchShrink = 0.5
+
+// TRPO implements Trust Region Policy Optimization.
+//
+// It wraps NaturalPG, using its natural gradient direction
+// (from whichever Solver is configured) as a search direction for a backtracking line
+// search that enforces a hard KL trust region (as opposed
+// to trusting the quadratic approximation to the KL that
+// the natural gradient direction is derived from).
+//
+// Unlike NaturalPG.Run, TRPO.Run applies the resulting
+// step directly to Params rather than merely returning a
+// gradient, since the step size is only known once the
+// line search completes.
+type TRPO struct {
+	*NaturalPG
+
+	// MaxKL is the maximum allowed (sampled) KL divergence
+	// between the old and new policy.
+	//
+	// If 0, a default of 0.01 is used.
+	MaxKL float64
+
+	// LineSearchIters is the number of backtracking steps
+	// to attempt before giving up.
+	//
+	// If 0, DefaultLineSearchIters is used.
+	LineSearchIters int
+
+	// LineSearchShrink is the factor by which the step size
+	// is shrunk after each failed backtracking attempt.
+	//
+	// If 0, DefaultLineSearchShrink is used.
+	LineSearchShrink float64
+}
+
+// Run computes the natural gradient direction and takes
+// the largest step along that direction (up to the full
+// natural gradient step) which both keeps the sampled KL
+// divergence under MaxKL and improves the surrogate
+// objective.
+//
+// The step is applied directly to t.Params. If no
+// satisfactory step is found within LineSearchIters
+// attempts, t.Params is left unchanged.
+//
+// It returns the vanilla (non-natural) policy gradient,
+// analogous to NaturalPG.Run.
+func (t *TRPO) Run(r *anyrl.RolloutSet) anydiff.Grad {
+	res := t.run(r)
+	if res.ZeroGrad {
+		return res.Grad
+	}
+	t.lineSearch(res)
+	return res.VanillaGrad
+}
+
+// lineSearch performs the backtracking search described in
+// Run, mutating t.Params in place.
+func (t *TRPO) lineSearch(res *naturalPGRes) {
+	c := res.Creator()
+
+	direction := res.Grad
+	quadForm := numToFloat64(dotGrad(res.VanillaGrad, direction))
+	if quadForm <= 0 {
+		return
+	}
+	stepSize := math.Sqrt(2 * t.maxKL() / quadForm)
+
+	oldParams := snapshotParams(t.Params)
+	_, oldSurrogate := t.evaluate(res)
+
+	backtrackingLineSearch(t.maxKL(), oldSurrogate, t.lineSearchIters(), t.shrink(), stepSize,
+		func(stepSize float64) (kl, surrogate float64) {
+			step := copyGrad(direction)
+			step.Scale(c.MakeNumeric(stepSize))
+			applyStep(t.Params, step)
+			return t.evaluate(res)
+		},
+		func() {
+			restoreParams(t.Params, oldParams)
+		})
+}
+
+// backtrackingLineSearch is the pure control flow behind
+// lineSearch: repeatedly calls tryStep with a shrinking step
+// size until one keeps kl under maxKL and improves surrogate
+// over oldSurrogate, undoing (via undoStep) and shrinking
+// after every failed attempt. tryStep is expected to apply
+// its step as a side effect before returning its
+// measurements, so that on success the winning step is left
+// in place.
+//
+// It returns whether a satisfactory step was found within
+// iters attempts; on failure, undoStep's last call has
+// already restored the pre-search state.
+func backtrackingLineSearch(maxKL, oldSurrogate float64, iters int, shrink, stepSize float64,
+	tryStep func(stepSize float64) (kl, surrogate float64), undoStep func()) bool {
+	for i := 0; i < iters; i++ {
+		kl, surrogate := tryStep(stepSize)
+		if kl <= maxKL && surrogate > oldSurrogate {
+			return true
+		}
+		undoStep()
+		stepSize *= shrink
+	}
+	return false
+}
+
+// evaluate computes the mean sampled KL divergence and the
+// surrogate objective between the cached pre-step policy
+// outputs (res.ReducedOut) and the outputs of the policy
+// under the current t.Params.
+func (t *TRPO) evaluate(res *naturalPGRes) (kl, surrogate float64) {
+	res.ReducedOut.Reuse()
+	newOuts := t.apply(lazyseq.TapeRereader(res.ReducedRollouts.Inputs), t.Policy)
+	return numToFloat64(meanKL(t.ActionSpace, res.ReducedOut, newOuts)),
+		numToFloat64(meanSurrogate(t.ActionSpace, res.ReducedOut, newOuts, res.ReducedRollouts))
+}
+
+func (t *TRPO) maxKL() float64 {
+	if t.MaxKL != 0 {
+		return t.MaxKL
+	}
+	return 0.01
+}
+
+func (t *TRPO) lineSearchIters() int {
+	if t.LineSearchIters != 0 {
+		return t.LineSearchIters
+	}
+	return DefaultLineSearchIters
+}
+
+func (t *TRPO) shrink() float64 {
+	if t.LineSearchShrink != 0 {
+		return t.LineSearchShrink
+	}
+	return DefaultLineSearchShrink
+}
+
+// meanKL computes the mean (over timesteps and batch
+// elements) KL divergence between two policy output
+// sequences produced from the same Inputs tape.
+func meanKL(space NaturalActionSpace, oldOuts, newOuts lazyseq.Rereader) anyvec.Numeric {
+	c := newOuts.Creator()
+	ops := c.NumOps()
+
+	oldCh := oldOuts.Forward()
+	newCh := newOuts.Forward()
+
+	var sum anyvec.Numeric
+	var count int
+	for newBatch := range newCh {
+		oldBatch := <-oldCh
+		kl := space.KL(anydiff.NewConst(oldBatch.Packed), anydiff.NewConst(newBatch.Packed),
+			newBatch.NumPresent())
+		batchSum := anyvec.Sum(kl.Output())
+		if sum == nil {
+			sum = batchSum
+		} else {
+			sum = ops.Add(sum, batchSum)
+		}
+		count += newBatch.NumPresent()
+	}
+	return ops.Div(sum, c.MakeNumeric(float64(count)))
+}
+
+// meanSurrogate computes the mean (over timesteps and
+// batch elements) PPO-style surrogate objective,
+// E[ratio(theta) * reward], between two policy output
+// sequences produced from the same Inputs tape.
+func meanSurrogate(space NaturalActionSpace, oldOuts, newOuts lazyseq.Rereader,
+	r *anyrl.RolloutSet) anyvec.Numeric {
+	c := newOuts.Creator()
+	ops := c.NumOps()
+
+	oldCh := oldOuts.Forward()
+	newCh := newOuts.Forward()
+	sampledCh := r.SampledOuts.ReadTape(0, -1)
+	rewardCh := r.Rewards.ReadTape(0, -1)
+
+	var sum anyvec.Numeric
+	var count int
+	for newBatch := range newCh {
+		oldBatch := <-oldCh
+		sampledBatch := <-sampledCh
+		rewardBatch := <-rewardCh
+
+		n := newBatch.NumPresent()
+		oldLogProb := space.LogProb(anydiff.NewConst(oldBatch.Packed), sampledBatch.Packed, n)
+		newLogProb := space.LogProb(anydiff.NewConst(newBatch.Packed), sampledBatch.Packed, n)
+		ratio := anydiff.Exp(anydiff.Sub(newLogProb, oldLogProb))
+		weighted := anydiff.Mul(ratio, anydiff.NewConst(rewardBatch.Packed))
+
+		batchSum := anyvec.Sum(weighted.Output())
+		if sum == nil {
+			sum = batchSum
+		} else {
+			sum = ops.Add(sum, batchSum)
+		}
+		count += n
+	}
+	return ops.Div(sum, c.MakeNumeric(float64(count)))
+}
+
+// snapshotParams saves the current values of params so
+// that they can later be restored with restoreParams.
+func snapshotParams(params []*anydiff.Var) []anyvec.Vector {
+	res := make([]anyvec.Vector, len(params))
+	for i, p := range params {
+		res[i] = p.Vector.Copy()
+	}
+	return res
+}
+
+// restoreParams undoes a step applied by applyStep,
+// resetting params to a snapshot taken by snapshotParams.
+func restoreParams(params []*anydiff.Var, snapshot []anyvec.Vector) {
+	for i, p := range params {
+		p.Vector.Set(snapshot[i])
+	}
+}
+
+// applyStep adds a step (e.g. a scaled natural gradient
+// direction) to params in place.
+func applyStep(params []*anydiff.Var, step anydiff.Grad) {
+	for _, p := range params {
+		if delta, ok := step[p]; ok {
+			p.Vector.Add(delta)
+		}
+	}
+}
+
+// numToFloat64 extracts a float64 from a Numeric, which is
+// always either a float32 or a float64 depending on the
+// anyvec.Creator in use.
+func numToFloat64(n anyvec.Numeric) float64 {
+	switch n := n.(type) {
+	case float32:
+		return float64(n)
+	case float64:
+		return n
+	default:
+		panic("unsupported numeric type")
+	}
+}
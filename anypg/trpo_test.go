@@ -0,0 +1,138 @@
+package anypg
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+)
+
+func TestNumToFloat64(t *testing.T) {
+	if v := numToFloat64(float32(1.5)); v != 1.5 {
+		t.Errorf("float32 case: got %v", v)
+	}
+	if v := numToFloat64(float64(2.5)); v != 2.5 {
+		t.Errorf("float64 case: got %v", v)
+	}
+}
+
+// TestBacktrackingLineSearchSucceeds checks that the search
+// stops at the first step size that satisfies both
+// conditions, shrinking past two attempts whose KL divergence
+// is still over budget.
+func TestBacktrackingLineSearchSucceeds(t *testing.T) {
+	var tried []float64
+	undone := 0
+
+	// KL only drops below maxKL (0.01) once stepSize has been
+	// shrunk twice: 1 -> 0.5 -> 0.25 gives kl = 0.03, 0.015
+	// and finally 0.25*0.03 = 0.0075 <= 0.01.
+	tryStep := func(stepSize float64) (kl, surrogate float64) {
+		tried = append(tried, stepSize)
+		return stepSize * 0.03, 1
+	}
+	undoStep := func() { undone++ }
+
+	ok := backtrackingLineSearch(0.01, 0, 10, 0.5, 1, tryStep, undoStep)
+	if !ok {
+		t.Fatal("expected the line search to succeed")
+	}
+	if want := []float64{1, 0.5, 0.25}; !float64SlicesEqual(tried, want) {
+		t.Errorf("expected step sizes %v, got %v", want, tried)
+	}
+	if undone != 2 {
+		t.Errorf("expected 2 undone (failed) attempts, got %d", undone)
+	}
+}
+
+// TestBacktrackingLineSearchGivesUp checks that the search
+// gives up (and has undone every attempt) after iters
+// attempts if no step size ever satisfies both conditions.
+func TestBacktrackingLineSearchGivesUp(t *testing.T) {
+	attempts := 0
+	undone := 0
+
+	tryStep := func(stepSize float64) (kl, surrogate float64) {
+		attempts++
+		return 100, 1 // KL is always far over budget.
+	}
+	undoStep := func() { undone++ }
+
+	ok := backtrackingLineSearch(0.01, 0, 4, 0.5, 1, tryStep, undoStep)
+	if ok {
+		t.Fatal("expected the line search to fail")
+	}
+	if attempts != 4 {
+		t.Errorf("expected 4 attempts, got %d", attempts)
+	}
+	if undone != 4 {
+		t.Errorf("expected every failed attempt to be undone, got %d", undone)
+	}
+}
+
+// TestBacktrackingLineSearchRequiresSurrogateImprovement
+// checks that a step which satisfies the KL bound but does
+// not improve the surrogate objective is still rejected.
+func TestBacktrackingLineSearchRequiresSurrogateImprovement(t *testing.T) {
+	tryStep := func(stepSize float64) (kl, surrogate float64) {
+		return 0, -1 // Comfortably under the KL bound, but worse than oldSurrogate.
+	}
+	ok := backtrackingLineSearch(0.01, 0, 3, 0.5, 1, tryStep, func() {})
+	if ok {
+		t.Fatal("expected a step that worsens the surrogate objective to be rejected")
+	}
+}
+
+func float64SlicesEqual(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestApplyStepSnapshotRestore checks the round trip used by
+// lineSearch to try and undo a step: applyStep adds a delta
+// to params, and restoreParams must put back exactly the
+// value snapshotParams captured beforehand, regardless of
+// what applyStep did in between.
+func TestApplyStepSnapshotRestore(t *testing.T) {
+	c := testCreator()
+	v := &anydiff.Var{Vector: scalarVec(c, 5)}
+	params := []*anydiff.Var{v}
+
+	snapshot := snapshotParams(params)
+	applyStep(params, anydiff.Grad{v: scalarVec(c, 2)})
+
+	if got := gradValue(c, anydiff.Grad{v: v.Vector}, v); !approxEqual(got, 7, 1e-6) {
+		t.Errorf("expected applyStep to add its delta, got %v", got)
+	}
+
+	restoreParams(params, snapshot)
+	if got := gradValue(c, anydiff.Grad{v: v.Vector}, v); !approxEqual(got, 5, 1e-6) {
+		t.Errorf("expected restoreParams to undo the step back to 5, got %v", got)
+	}
+}
+
+func TestTRPODefaults(t *testing.T) {
+	t1 := &TRPO{}
+	if t1.maxKL() != 0.01 {
+		t.Errorf("expected default MaxKL of 0.01, got %v", t1.maxKL())
+	}
+	if t1.lineSearchIters() != DefaultLineSearchIters {
+		t.Errorf("expected default LineSearchIters of %v, got %v", DefaultLineSearchIters,
+			t1.lineSearchIters())
+	}
+	if t1.shrink() != DefaultLineSearchShrink {
+		t.Errorf("expected default LineSearchShrink of %v, got %v", DefaultLineSearchShrink,
+			t1.shrink())
+	}
+
+	t2 := &TRPO{MaxKL: 0.5, LineSearchIters: 3, LineSearchShrink: 0.1}
+	if t2.maxKL() != 0.5 || t2.lineSearchIters() != 3 || t2.shrink() != 0.1 {
+		t.Errorf("explicit TRPO settings were not honored: %+v", t2)
+	}
+}
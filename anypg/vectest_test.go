@@ -0,0 +1,57 @@
+package anypg
+
+import (
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+)
+
+// testCreator is the anyvec.Creator used to build the small,
+// hand-constructed gradients in this package's tests. anyvec64
+// is used (rather than anyvec32) so that float comparisons
+// against hand-derived values can use a tight tolerance.
+func testCreator() anyvec.Creator {
+	return anyvec64.DefaultCreator{}
+}
+
+// scalarVec creates a length-1 vector holding value.
+func scalarVec(c anyvec.Creator, value float64) anyvec.Vector {
+	v := c.MakeVector(1)
+	v.AddScalar(c.MakeNumeric(value))
+	return v
+}
+
+// scalarVar wraps a fresh length-1 vector in its own
+// *anydiff.Var, for use as a dimGrad map key.
+func scalarVar(c anyvec.Creator) *anydiff.Var {
+	return &anydiff.Var{Vector: c.MakeVector(1)}
+}
+
+// dimGrad builds a Grad representing the small vector
+// `values`, using one scalarVec per dimension. Since
+// dotGrad/addToGrad/subFromGrad/etc. all work by summing or
+// zipping over a Grad's map entries, N independent 1-length
+// entries behave exactly like one N-length vector would,
+// without needing to know anyvec64's multi-element vector
+// construction API.
+func dimGrad(c anyvec.Creator, vars []*anydiff.Var, values []float64) anydiff.Grad {
+	g := anydiff.Grad{}
+	for i, v := range vars {
+		g[v] = scalarVec(c, values[i])
+	}
+	return g
+}
+
+// gradValue reads a single dimension's value back out of a
+// Grad built by dimGrad.
+func gradValue(c anyvec.Creator, g anydiff.Grad, v *anydiff.Var) float64 {
+	return numToFloat64(g[v].Dot(scalarVec(c, 1)))
+}
+
+func approxEqual(a, b, delta float64) bool {
+	diff := a - b
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= delta
+}